@@ -14,16 +14,22 @@
 package main
 
 import (
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/HdrHistogram/hdrhistogram-go"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/bench"
 
@@ -40,18 +46,322 @@ const (
 	DefaultIgnoreOld          = false
 	DefaultMaxPubAcksInflight = 512
 	DefaultClientID           = "benchmark"
+	DefaultTransport          = "stan"
+	DefaultStreamName         = "benchmark"
+	DefaultConsumerAckPolicy  = "explicit"
+	DefaultStorageType        = "file"
+	DefaultReplicas           = 1
+	// PayloadRandPoolSize is how many distinct random buffers -payload-rand
+	// round-robins through. Generating just one and reusing it would make
+	// every message byte-identical, defeating the point of random payloads
+	// for exercising any compression or dedupe downstream.
+	PayloadRandPoolSize = 64
+	// HistMinValue and HistMaxValue bound the latency histograms to 1
+	// microsecond and 1 minute, which comfortably covers pub/sub round
+	// trips without wasting histogram buckets.
+	HistMinValue = int64(time.Microsecond)
+	HistMaxValue = int64(time.Minute)
+	HistSigFigs  = 3
 )
 
 func usage() {
-	log.Fatalf("Usage: stan-bench [-s server (%s)] [-c CLUSTER_ID] [-id CLIENT_ID] [-qgroup QUEUE_GROUP_NAME] [-np NUM_PUBLISHERS] [-ns NUM_SUBSCRIBERS] [-n NUM_MSGS] [-ms MESSAGE_SIZE] [-csv csvfile] [-mpa MAX_NUMBER_OF_PUBLISHED_ACKS_INFLIGHT] [-io] [-sync] [--creds credentials_file] [-cd PATH_TO_CERTS] [-cf CERTIFICATE_FILE] [-ck CERTIFICATE_KEY] [-u USERID] [-pw PASSWORD] <subject>\n", nats.DefaultURL)
+	log.Fatalf("Usage: stan-bench [-s server (%s)] [-c CLUSTER_ID] [-id CLIENT_ID] [-qgroup QUEUE_GROUP_NAME] [-np NUM_PUBLISHERS] [-ns NUM_SUBSCRIBERS] [-n NUM_MSGS] [-ms MESSAGE_SIZE] [-csv csvfile] [-mpa MAX_NUMBER_OF_PUBLISHED_ACKS_INFLIGHT] [-io] [-sync] [--creds credentials_file] [-cd PATH_TO_CERTS] [-cf CERTIFICATE_FILE] [-ck CERTIFICATE_KEY] [-u USERID] [-pw PASSWORD] [-payload FILE] [-payload-dir DIR] [-payload-rand] [-hist] [-hist-out FILE] [-transport core|stan|js] [-stream STREAM_NAME] [-consumer CONSUMER_NAME] [-ack none|explicit|all] [-storage file|memory] [-replicas NUM_REPLICAS] [-rate MSGS_PER_SEC] [-warmup DURATION] [-cooldown DURATION] <subject>\n", nats.DefaultURL)
 }
 
 var (
 	benchmark  *bench.Benchmark
 	qTotalRecv int32
 	qSubsLeft  int32
+
+	// histMu guards merges of per-goroutine histograms into the two
+	// process-wide ones below; hdrhistogram.Histogram is not safe for
+	// concurrent RecordValue/Merge calls.
+	histMu         sync.Mutex
+	pubAckHist     *hdrhistogram.Histogram
+	subLatencyHist *hdrhistogram.Histogram
 )
 
+// AckHandler is invoked when an asynchronously published message is acked
+// (or fails to be). Unlike stan.go's ack callback it carries no ack id:
+// callers that need to correlate a specific publish with its ack close
+// over whatever they need (e.g. a send timestamp) directly instead.
+type AckHandler func(err error)
+
+// MsgHandler is invoked for each message delivered to a subscription.
+type MsgHandler func(data []byte)
+
+// SubOpts configures a PubSub.Subscribe call. Not every transport honors
+// every field: DeliverAll applies to stan and js; Durable and AckPolicy
+// apply to js only.
+type SubOpts struct {
+	DeliverAll bool
+	Durable    string
+	AckPolicy  string
+}
+
+// Sub is a handle to an active subscription.
+type Sub interface {
+	Unsubscribe() error
+}
+
+// PubSub is a connected publish/subscribe session against one transport.
+type PubSub interface {
+	Publish(subj string, data []byte) error
+	PublishAsync(subj string, data []byte, cb AckHandler) error
+	Subscribe(subj, queue string, opts SubOpts, cb MsgHandler) (Sub, error)
+	Close()
+	NatsConn() *nats.Conn
+}
+
+// Transport connects to a messaging backend and returns a PubSub bound to
+// it. coreTransport, stanTransport and jsTransport let the same
+// -np/-ns/-qgroup/-ms/-n/-csv flags drive NATS core, NATS Streaming or
+// JetStream, so results are directly comparable across all three.
+type Transport interface {
+	Connect(url string, opts []nats.Option, id string) (PubSub, error)
+}
+
+// coreTransport benches plain core NATS: no persistence, no acks, fire and
+// forget. It's the baseline the other two transports are measured against.
+type coreTransport struct{}
+
+func (t *coreTransport) Connect(url string, opts []nats.Option, id string) (PubSub, error) {
+	nc, err := nats.Connect(url, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &corePubSub{nc: nc}, nil
+}
+
+type corePubSub struct {
+	nc *nats.Conn
+}
+
+func (p *corePubSub) Publish(subj string, data []byte) error {
+	return p.nc.Publish(subj, data)
+}
+
+// PublishAsync has nothing to wait on under core NATS, so the ack fires as
+// soon as the message is handed to the client library.
+func (p *corePubSub) PublishAsync(subj string, data []byte, cb AckHandler) error {
+	if err := p.nc.Publish(subj, data); err != nil {
+		return err
+	}
+	cb(nil)
+	return nil
+}
+
+func (p *corePubSub) Subscribe(subj, queue string, opts SubOpts, cb MsgHandler) (Sub, error) {
+	handler := func(msg *nats.Msg) { cb(msg.Data) }
+	if queue != "" {
+		return p.nc.QueueSubscribe(subj, queue, handler)
+	}
+	return p.nc.Subscribe(subj, handler)
+}
+
+func (p *corePubSub) Close()               { p.nc.Close() }
+func (p *corePubSub) NatsConn() *nats.Conn { return p.nc }
+
+// stanTransport benches NATS Streaming, reusing the same clusterID and
+// max-pub-acks-inflight setting for every connection it opens.
+type stanTransport struct {
+	clusterID          string
+	maxPubAcksInflight int
+}
+
+func (t *stanTransport) Connect(url string, opts []nats.Option, id string) (PubSub, error) {
+	nc, err := nats.Connect(url, opts...)
+	if err != nil {
+		return nil, err
+	}
+	snc, err := stan.Connect(t.clusterID, id, stan.MaxPubAcksInflight(t.maxPubAcksInflight), stan.NatsConn(nc),
+		stan.SetConnectionLostHandler(func(_ stan.Conn, reason error) {
+			log.Fatalf("Connection lost, reason: %v", reason)
+		}))
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return &stanPubSub{snc: snc}, nil
+}
+
+type stanPubSub struct {
+	snc stan.Conn
+}
+
+func (p *stanPubSub) Publish(subj string, data []byte) error {
+	return p.snc.Publish(subj, data)
+}
+
+func (p *stanPubSub) PublishAsync(subj string, data []byte, cb AckHandler) error {
+	_, err := p.snc.PublishAsync(subj, data, func(_ string, err error) { cb(err) })
+	return err
+}
+
+func (p *stanPubSub) Subscribe(subj, queue string, opts SubOpts, cb MsgHandler) (Sub, error) {
+	handler := func(msg *stan.Msg) { cb(msg.Data) }
+	var subOpts []stan.SubscriptionOption
+	if opts.DeliverAll {
+		subOpts = append(subOpts, stan.DeliverAllAvailable())
+	}
+	return p.snc.QueueSubscribe(subj, queue, handler, subOpts...)
+}
+
+func (p *stanPubSub) Close()               { p.snc.Close() }
+func (p *stanPubSub) NatsConn() *nats.Conn { return p.snc.NatsConn() }
+
+// jsTransport benches JetStream. Unlike stan and core, the stream itself is
+// shared infrastructure set up once via setupStream before any publisher or
+// subscriber connects, not per connection.
+type jsTransport struct {
+	maxPubAcksInflight int
+}
+
+func (t *jsTransport) Connect(url string, opts []nats.Option, id string) (PubSub, error) {
+	nc, err := nats.Connect(url, opts...)
+	if err != nil {
+		return nil, err
+	}
+	js, err := nc.JetStream(nats.PublishAsyncMaxPending(t.maxPubAcksInflight))
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return &jsPubSub{nc: nc, js: js}, nil
+}
+
+type jsPubSub struct {
+	nc *nats.Conn
+	js nats.JetStreamContext
+}
+
+func (p *jsPubSub) Publish(subj string, data []byte) error {
+	_, err := p.js.Publish(subj, data)
+	return err
+}
+
+// PublishAsync hands back a per-message PubAckFuture, so unlike stan's
+// single shared ack callback, each call gets its own goroutine waiting on
+// its own future; there's no ack id to correlate.
+func (p *jsPubSub) PublishAsync(subj string, data []byte, cb AckHandler) error {
+	future, err := p.js.PublishAsync(subj, data)
+	if err != nil {
+		return err
+	}
+	go func() {
+		select {
+		case <-future.Ok():
+			cb(nil)
+		case err := <-future.Err():
+			cb(err)
+		}
+	}()
+	return nil
+}
+
+// Subscribe creates a push consumer, unless opts.Durable is set without a
+// queue group, in which case it creates a pull consumer instead: that's the
+// -consumer-without--qgroup case advertised by the -consumer flag's help
+// text.
+func (p *jsPubSub) Subscribe(subj, queue string, opts SubOpts, cb MsgHandler) (Sub, error) {
+	if opts.Durable != "" && queue == "" {
+		return p.pullSubscribe(subj, opts, cb)
+	}
+
+	handler := func(msg *nats.Msg) {
+		if opts.AckPolicy != "none" {
+			msg.Ack()
+		}
+		cb(msg.Data)
+	}
+	var subOpts []nats.SubOpt
+	if opts.DeliverAll {
+		subOpts = append(subOpts, nats.DeliverAll())
+	} else {
+		subOpts = append(subOpts, nats.DeliverNew())
+	}
+	switch opts.AckPolicy {
+	case "none":
+		subOpts = append(subOpts, nats.AckNone())
+	case "all":
+		subOpts = append(subOpts, nats.AckAll())
+	default:
+		subOpts = append(subOpts, nats.AckExplicit())
+	}
+	if opts.Durable != "" {
+		subOpts = append(subOpts, nats.Durable(opts.Durable))
+	}
+	if queue != "" {
+		return p.js.QueueSubscribe(subj, queue, handler, subOpts...)
+	}
+	return p.js.Subscribe(subj, handler, subOpts...)
+}
+
+// pullSubscribe binds a durable pull consumer and fetches messages for it
+// in a loop on a background goroutine, delivering each to cb the same way
+// the push path does.
+func (p *jsPubSub) pullSubscribe(subj string, opts SubOpts, cb MsgHandler) (Sub, error) {
+	var subOpts []nats.SubOpt
+	if opts.DeliverAll {
+		subOpts = append(subOpts, nats.DeliverAll())
+	} else {
+		subOpts = append(subOpts, nats.DeliverNew())
+	}
+	switch opts.AckPolicy {
+	case "none":
+		subOpts = append(subOpts, nats.AckNone())
+	case "all":
+		subOpts = append(subOpts, nats.AckAll())
+	default:
+		subOpts = append(subOpts, nats.AckExplicit())
+	}
+
+	sub, err := p.js.PullSubscribe(subj, opts.Durable, subOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			msgs, err := sub.Fetch(1, nats.MaxWait(time.Second))
+			if err != nil {
+				if err == nats.ErrTimeout {
+					continue
+				}
+				return
+			}
+			for _, msg := range msgs {
+				if opts.AckPolicy != "none" {
+					msg.Ack()
+				}
+				cb(msg.Data)
+			}
+		}
+	}()
+	return &pullSub{sub: sub, stop: stop}, nil
+}
+
+// pullSub wraps a pull consumer's *nats.Subscription so Unsubscribe also
+// stops the background Fetch loop started by pullSubscribe.
+type pullSub struct {
+	sub  *nats.Subscription
+	stop chan struct{}
+}
+
+func (s *pullSub) Unsubscribe() error {
+	close(s.stop)
+	return s.sub.Unsubscribe()
+}
+
+func (p *jsPubSub) Close()               { p.nc.Close() }
+func (p *jsPubSub) NatsConn() *nats.Conn { return p.nc }
+
 func main() {
 	var clusterID string
 	flag.StringVar(&clusterID, "c", "test-cluster", "The NATS Streaming cluster ID")
@@ -75,6 +385,24 @@ func main() {
 	var user = flag.String("u", "", "user id")
 	var pswd = flag.String("pw", "", "password")
 
+	var payloadFile = flag.String("payload", "", "File to use as the message payload")
+	var payloadDir = flag.String("payload-dir", "", "Directory of files to round-robin as the message payload")
+	var payloadRand = flag.Bool("payload-rand", false, "Fill the message payload with random bytes of size -ms")
+
+	var transportName = flag.String("transport", DefaultTransport, "Transport to benchmark: core|stan|js")
+	var streamName = flag.String("stream", DefaultStreamName, "JetStream stream name")
+	var consumerName = flag.String("consumer", "", "JetStream durable consumer name (pull consumer when set without -qgroup)")
+	var ackPolicy = flag.String("ack", DefaultConsumerAckPolicy, "JetStream consumer ack policy: none|explicit|all")
+	var storageType = flag.String("storage", DefaultStorageType, "JetStream stream storage: file|memory")
+	var replicas = flag.Int("replicas", DefaultReplicas, "JetStream stream replicas")
+
+	var hist = flag.Bool("hist", false, "Record publish-ack and end-to-end latency histograms")
+	var histOut = flag.String("hist-out", "", "Dump the end-to-end latency histogram (gzip-compressed) to file")
+
+	var rate = flag.Int("rate", 0, "Aggregate publish rate limit in msgs/sec across all publishers (0 = unlimited)")
+	var warmup = flag.Duration("warmup", 0, "Warmup period during which published/received messages are not sampled")
+	var cooldown = flag.Duration("cooldown", 0, "Cooldown period during which sampling stops but publishing/subscribing continues to drain")
+
 	log.SetFlags(0)
 	flag.Usage = usage
 	flag.Parse()
@@ -83,6 +411,7 @@ func main() {
 	if len(args) != 1 {
 		usage()
 	}
+	subj := args[0]
 
 	// Setup the connect options
 	opts := []nats.Option{nats.Name("NATS Streaming Benchmark")}
@@ -107,7 +436,33 @@ func main() {
 		}
 	}
 
-	benchmark = bench.NewBenchmark("NATS Streaming", *numSubs, *numPubs)
+	var transport Transport
+	var benchmarkName string
+	switch *transportName {
+	case "core":
+		transport = &coreTransport{}
+		benchmarkName = "Core NATS"
+	case "js":
+		transport = &jsTransport{maxPubAcksInflight: *maxPubAcks}
+		benchmarkName = "NATS JetStream"
+	case "stan":
+		transport = &stanTransport{clusterID: clusterID, maxPubAcksInflight: *maxPubAcks}
+		benchmarkName = "NATS Streaming"
+	default:
+		usage()
+	}
+	benchmark = bench.NewBenchmark(benchmarkName, *numSubs, *numPubs)
+
+	if *transportName == "js" {
+		setupStream(*urls, opts, *streamName, subj, *storageType, *replicas)
+	}
+
+	payloads := loadPayloads(*payloadFile, *payloadDir, *payloadRand, *messageSize)
+
+	if *hist {
+		pubAckHist = hdrhistogram.New(HistMinValue, HistMaxValue, HistSigFigs)
+		subLatencyHist = hdrhistogram.New(HistMinValue, HistMaxValue, HistSigFigs)
+	}
 
 	var startwg sync.WaitGroup
 	var donewg sync.WaitGroup
@@ -121,22 +476,28 @@ func main() {
 	startwg.Add(*numSubs)
 	for i := 0; i < *numSubs; i++ {
 		subID := fmt.Sprintf("%s-sub-%d", *clientID, i)
-		go runSubscriber(&startwg, &donewg, *urls, opts, clusterID, subID, *queue, *numMsgs, *messageSize, *ignoreOld)
+		subOpts := SubOpts{DeliverAll: !*ignoreOld, AckPolicy: *ackPolicy}
+		if *consumerName != "" {
+			subOpts.Durable = fmt.Sprintf("%s-%s", *consumerName, subID)
+		}
+		go runSubscriber(transport, &startwg, &donewg, *urls, opts, subID, *queue, *numMsgs, *messageSize, subOpts, *hist, *warmup, *cooldown)
 	}
 	startwg.Wait()
 
 	// Now Publishers
+	rl := newRateLimiter(*rate)
 	startwg.Add(*numPubs)
 	pubCounts := bench.MsgsPerClient(*numMsgs, *numPubs)
 	for i := 0; i < *numPubs; i++ {
 		pubID := fmt.Sprintf("%s-pub-%d", *clientID, i)
-		go runPublisher(&startwg, &donewg, *urls, opts, clusterID, pubCounts[i], *messageSize, *syncPub, pubID, *maxPubAcks)
+		go runPublisher(transport, &startwg, &donewg, *urls, opts, pubCounts[i], *messageSize, *syncPub, pubID, payloads, *hist, rl, *warmup, *cooldown)
 	}
 
-	log.Printf("Starting benchmark [msgs=%d, msgsize=%d, pubs=%d, subs=%d]\n", *numMsgs, *messageSize, *numPubs, *numSubs)
+	log.Printf("Starting benchmark [msgs=%d, msgsize=%d, pubs=%d, subs=%d, rate=%d, warmup=%s, cooldown=%s]\n", *numMsgs, *messageSize, *numPubs, *numSubs, *rate, *warmup, *cooldown)
 
 	startwg.Wait()
 	donewg.Wait()
+	rl.close()
 
 	benchmark.Close()
 	fmt.Print(benchmark.Report())
@@ -146,17 +507,241 @@ func main() {
 		ioutil.WriteFile(*csvFile, []byte(csv), 0644)
 		fmt.Printf("Saved metric data in csv file %s\n", *csvFile)
 	}
+
+	if *hist {
+		printLatency("Pub ack", pubAckHist)
+		printLatency("End-to-end", subLatencyHist)
+		if len(*histOut) > 0 {
+			if err := dumpHistogram(*histOut, subLatencyHist); err != nil {
+				log.Fatalf("Can't save histogram to %q: %v\n", *histOut, err)
+			}
+			fmt.Printf("Saved end-to-end latency histogram in %s\n", *histOut)
+		}
+	}
+}
+
+// printLatency reports the standard tail-latency quantiles for a histogram,
+// or does nothing if it never recorded a value (e.g. a -sync publisher run,
+// which has no async ack latency to report).
+func printLatency(name string, h *hdrhistogram.Histogram) {
+	if h.TotalCount() == 0 {
+		return
+	}
+	fmt.Printf("%s latency: p50=%s p90=%s p99=%s p99.9=%s max=%s\n",
+		name,
+		time.Duration(h.ValueAtQuantile(50)),
+		time.Duration(h.ValueAtQuantile(90)),
+		time.Duration(h.ValueAtQuantile(99)),
+		time.Duration(h.ValueAtQuantile(99.9)),
+		time.Duration(h.Max()),
+	)
+}
+
+// dumpHistogram gzip-compresses the histogram's exported snapshot to path so
+// runs on different hardware can be merged and compared later.
+func dumpHistogram(path string, h *hdrhistogram.Histogram) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gw := gzip.NewWriter(f)
+	if err := json.NewEncoder(gw).Encode(h.Export()); err != nil {
+		return err
+	}
+	return gw.Close()
 }
 
-func runPublisher(startwg, donewg *sync.WaitGroup, url string, opts []nats.Option, clusterID string, numMsgs, msgSize int, sync bool, pubID string, maxPubAcksInflight int) {
+// setupStream connects to the server and creates the benchmark stream if it
+// doesn't already exist, binding it to subj. If the stream exists, its
+// config is left untouched so repeated runs against the same stream compare
+// apples to apples.
+func setupStream(url string, opts []nats.Option, streamName, subj, storageType string, replicas int) {
 	nc, err := nats.Connect(url, opts...)
 	if err != nil {
-		log.Fatalf("Publisher %s can't connect: %v\n", pubID, err)
+		log.Fatalf("Couldn't connect to NATS: %v\n", err)
 	}
-	snc, err := stan.Connect(clusterID, pubID, stan.MaxPubAcksInflight(maxPubAcksInflight), stan.NatsConn(nc),
-		stan.SetConnectionLostHandler(func(_ stan.Conn, reason error) {
-			log.Fatalf("Connection lost, reason: %v", reason)
-		}))
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	if err != nil {
+		log.Fatalf("Couldn't get JetStream context: %v\n", err)
+	}
+
+	storage := nats.FileStorage
+	if storageType == "memory" {
+		storage = nats.MemoryStorage
+	}
+
+	if _, err := js.StreamInfo(streamName); err != nil {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:     streamName,
+			Subjects: []string{subj},
+			Storage:  storage,
+			Replicas: replicas,
+		})
+		if err != nil {
+			log.Fatalf("Couldn't create stream %q: %v\n", streamName, err)
+		}
+	}
+}
+
+// loadPayloads resolves the -payload/-payload-dir/-payload-rand flags into
+// the set of buffers publishers round-robin over. Exactly one of the modes
+// applies; when none are set it falls back to a single zero-filled buffer of
+// msgSize, matching the upstream stan-bench default. -payload-rand returns a
+// pool of PayloadRandPoolSize distinct buffers rather than one reused buffer,
+// so messages aren't all byte-identical.
+func loadPayloads(payloadFile, payloadDir string, payloadRand bool, msgSize int) [][]byte {
+	switch {
+	case payloadDir != "":
+		entries, err := ioutil.ReadDir(payloadDir)
+		if err != nil {
+			log.Fatalf("Can't read payload directory %q: %v\n", payloadDir, err)
+		}
+		var payloads [][]byte
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(payloadDir, entry.Name()))
+			if err != nil {
+				log.Fatalf("Can't read payload file %q: %v\n", entry.Name(), err)
+			}
+			payloads = append(payloads, data)
+		}
+		if len(payloads) == 0 {
+			log.Fatalf("No payload files found in %q\n", payloadDir)
+		}
+		return payloads
+	case payloadFile != "":
+		data, err := ioutil.ReadFile(payloadFile)
+		if err != nil {
+			log.Fatalf("Can't read payload file %q: %v\n", payloadFile, err)
+		}
+		return [][]byte{data}
+	case payloadRand:
+		payloads := make([][]byte, PayloadRandPoolSize)
+		for i := range payloads {
+			msg := make([]byte, msgSize)
+			if _, err := rand.Read(msg); err != nil {
+				log.Fatalf("Can't generate random payload: %v\n", err)
+			}
+			payloads[i] = msg
+		}
+		return payloads
+	default:
+		return [][]byte{make([]byte, msgSize)}
+	}
+}
+
+// withLatencyPrefix returns a copy of buf with an 8-byte nanosecond
+// timestamp prepended, so a subscriber can compute end-to-end latency
+// without any clock sync assumption beyond "same host". Opt-in via -hist:
+// it costs an allocation and 8 bytes of payload per message.
+func withLatencyPrefix(buf []byte) []byte {
+	data := make([]byte, 8+len(buf))
+	binary.BigEndian.PutUint64(data[:8], uint64(time.Now().UnixNano()))
+	copy(data[8:], buf)
+	return data
+}
+
+// recordLatency decodes the timestamp written by withLatencyPrefix and
+// records the elapsed time into h. Messages shorter than the prefix (e.g.
+// "done" queue unblock markers) are silently ignored.
+func recordLatency(h *hdrhistogram.Histogram, data []byte) {
+	if len(data) < 8 {
+		return
+	}
+	sentAt := int64(binary.BigEndian.Uint64(data[:8]))
+	h.RecordValue(int64(time.Since(time.Unix(0, sentAt))))
+}
+
+// rateLimiter paces aggregate publish throughput across every publisher
+// goroutine through a single shared token bucket, so the target msgs/sec is
+// honored in aggregate no matter how many -np publishers are splitting the
+// work. A nil *rateLimiter (the -rate=0 default) imposes no pacing at all.
+type rateLimiter struct {
+	tokens chan struct{}
+	stop   chan struct{}
+}
+
+func newRateLimiter(msgsPerSec int) *rateLimiter {
+	if msgsPerSec <= 0 {
+		return nil
+	}
+	interval := time.Second / time.Duration(msgsPerSec)
+	if interval <= 0 {
+		interval = time.Nanosecond
+	}
+	rl := &rateLimiter{
+		tokens: make(chan struct{}, msgsPerSec),
+		stop:   make(chan struct{}),
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case rl.tokens <- struct{}{}:
+				default:
+				}
+			case <-rl.stop:
+				return
+			}
+		}
+	}()
+	return rl
+}
+
+// wait blocks until a token is available. It is safe to call from multiple
+// publisher goroutines concurrently, and a nil receiver never blocks.
+func (rl *rateLimiter) wait() {
+	if rl == nil {
+		return
+	}
+	<-rl.tokens
+}
+
+func (rl *rateLimiter) close() {
+	if rl == nil {
+		return
+	}
+	close(rl.stop)
+}
+
+// sampleWindow trims the first warmup and last cooldown out of a goroutine's
+// recorded message timestamps and reports the count and time span of what's
+// left, so benchmark samples only reflect the steady-state middle of a run.
+// ok is false if nothing survives the trim, e.g. a run shorter than
+// warmup+cooldown.
+func sampleWindow(times []time.Time, warmup, cooldown time.Duration) (count int, start, end time.Time, ok bool) {
+	if len(times) == 0 {
+		return 0, time.Time{}, time.Time{}, false
+	}
+	warmupEnd := times[0].Add(warmup)
+	cooldownStart := times[len(times)-1].Add(-cooldown)
+	for _, t := range times {
+		if t.Before(warmupEnd) || t.After(cooldownStart) {
+			continue
+		}
+		if count == 0 {
+			start = t
+		}
+		end = t
+		count++
+	}
+	return count, start, end, count > 0
+}
+
+// runPublisher drives one publisher goroutine against whatever Transport it
+// is given, so the same benchmark loop runs unmodified against core NATS,
+// NATS Streaming or JetStream.
+func runPublisher(t Transport, startwg, donewg *sync.WaitGroup, url string, opts []nats.Option, numMsgs, msgSize int, syncPub bool, pubID string, payloads [][]byte, hist bool, rl *rateLimiter, warmup, cooldown time.Duration) {
+	ps, err := t.Connect(url, opts, pubID)
 	if err != nil {
 		log.Fatalf("Publisher %s can't connect: %v\n", pubID, err)
 	}
@@ -164,30 +749,50 @@ func runPublisher(startwg, donewg *sync.WaitGroup, url string, opts []nats.Optio
 	startwg.Done()
 
 	args := flag.Args()
-
 	subj := args[0]
-	var msg []byte
-	if msgSize > 0 {
-		//msg = make([]byte, msgSize)
-		msg = []byte{10,213,14,123,34,114,101,113,117,101,115,116,95,105,100,34,58,34,56,97,54,54,57,53,55,34,44,34,114,101,113,117,101,115,116,95,109,101,116,104,111,100,34,58,34,80,79,83,84,34,44,34,114,101,113,117,101,115,116,95,117,114,108,34,58,34,104,116,116,112,115,58,47,47,97,112,105,46,105,116,101,114,97,98,108,101,46,99,111,109,47,97,112,105,47,101,118,101,110,116,115,47,116,114,97,99,107,34,44,34,111,112,101,114,97,116,105,111,110,95,116,121,112,101,34,58,34,84,114,97,99,107,69,118,101,110,116,34,44,34,117,115,101,114,95,103,108,111,98,97,108,95,105,100,34,58,34,48,100,56,57,101,53,102,99,57,99,52,56,54,97,51,97,99,52,100,53,54,101,56,55,51,52,98,56,51,57,53,99,102,101,34,44,34,116,105,109,101,95,117,110,105,120,34,58,49,54,48,52,52,56,54,52,56,57,44,34,112,114,111,112,101,114,116,105,101,115,34,58,34,123,92,34,101,118,101,110,116,78,97,109,101,92,34,58,92,34,97,99,116,105,118,105,116,121,112,97,103,101,92,34,44,92,34,99,114,101,97,116,101,100,65,116,92,34,58,49,54,48,52,52,56,54,52,56,55,57,55,50,44,92,34,100,97,116,97,70,105,101,108,100,115,92,34,58,123,92,34,97,99,116,105,118,105,116,121,73,68,92,34,58,52,53,54,48,56,44,92,34,97,99,116,105,118,105,116,121,73,109,97,103,101,92,34,58,92,34,47,97,99,116,105,118,105,116,105,101,115,47,110,117,103,121,104,115,101,101,110,119,52,112,122,121,107,122,118,102,100,117,46,106,112,103,92,34,44,92,34,97,99,116,105,118,105,116,121,78,97,109,101,92,34,58,92,34,231,141,168,229,174,182,229,132,170,230,131,160,239,188,154,233,166,153,230,184,175,229,155,155,229,173,163,233,133,146,229,186,151,228,189,143,229,174,191,229,165,151,233,164,144,92,34,44,92,34,97,99,116,105,118,105,116,121,80,114,105,99,101,92,34,58,92,34,72,75,36,50,44,53,51,48,92,34,44,92,34,98,111,111,107,105,110,103,78,117,109,98,101,114,92,34,58,49,51,54,54,44,92,34,99,97,116,101,103,111,114,121,73,68,92,34,58,51,44,92,34,99,105,116,121,73,68,92,34,58,50,44,92,34,99,105,116,121,78,97,109,101,92,34,58,92,34,233,166,153,230,184,175,92,34,44,92,34,99,105,116,121,85,82,76,92,34,58,92,34,104,116,116,112,115,58,47,47,119,119,119,46,107,108,111,111,107,46,99,111,109,47,122,104,45,72,75,47,99,105,116,121,47,50,92,34,44,92,34,99,111,117,110,116,114,121,73,68,92,34,58,50,44,92,34,112,97,103,101,85,82,76,92,34,58,92,34,104,116,116,112,115,58,47,47,119,119,119,46,107,108,111,111,107,46,99,111,109,47,122,104,45,72,75,47,97,99,116,105,118,105,116,121,47,52,53,54,48,56,92,34,44,92,34,112,108,97,116,102,111,114,109,92,34,58,92,34,65,110,100,114,111,105,100,92,34,44,92,34,114,101,99,111,109,109,101,110,100,101,100,65,99,116,105,118,105,116,121,49,92,34,58,123,92,34,73,109,97,103,101,85,82,76,92,34,58,92,34,104,116,116,112,115,58,47,47,114,101,115,46,107,108,111,111,107,46,99,111,109,47,105,109,97,103,101,47,117,112,108,111,97,100,47,97,99,116,105,118,105,116,105,101,115,47,102,57,53,98,53,101,101,102,45,65,113,117,97,76,117,110,97,45,78,105,103,104,116,45,67,114,117,105,115,101,46,106,112,103,92,34,44,92,34,78,97,109,101,92,34,58,92,34,229,188,181,228,191,157,228,187,148,232,153,159,233,171,148,233,169,151,228,185,139,230,151,133,32,40,230,140,135,229,174,154,230,153,130,229,128,153,232,178,183,51,233,128,129,49,41,92,34,44,92,34,80,114,105,99,101,92,34,58,92,34,72,75,36,50,48,49,46,48,92,34,44,92,34,98,111,111,107,105,110,103,78,117,109,98,101,114,92,34,58,49,49,56,53,49,54,44,92,34,112,97,103,101,85,82,76,92,34,58,92,34,104,116,116,112,115,58,47,47,119,119,119,46,107,108,111,111,107,46,99,111,109,47,122,104,45,72,75,47,97,99,116,105,118,105,116,121,47,54,53,57,92,34,44,92,34,114,101,118,105,101,119,78,117,109,98,101,114,92,34,58,53,57,50,57,44,92,34,114,101,118,105,101,119,82,97,116,105,110,103,92,34,58,52,46,55,125,44,92,34,114,101,99,111,109,109,101,110,100,101,100,65,99,116,105,118,105,116,121,50,92,34,58,123,92,34,73,109,97,103,101,85,82,76,92,34,58,92,34,104,116,116,112,115,58,47,47,114,101,115,46,107,108,111,111,107,46,99,111,109,47,105,109,97,103,101,47,117,112,108,111,97,100,47,97,99,116,105,118,105,116,105,101,115,47,111,56,120,106,107,49,113,97,121,103,114,109,117,115,119,108,103,118,103,107,46,106,112,103,92,34,44,92,34,78,97,109,101,92,34,58,92,34,227,128,144,229,141,179,232,178,183,229,141,179,231,148,168,227,128,145,233,166,153,230,184,175,230,169,159,229,160,180,229,191,171,231,183,154,232,187,138,231,165,168,239,188,136,230,142,131,81,82,32,67,111,100,101,231,155,180,230,142,165,229,133,165,233,150,152,239,188,137,92,34,44,92,34,80,114,105,99,101,92,34,58,92,34,72,75,36,52,57,46,48,92,34,44,92,34,98,111,111,107,105,110,103,78,117,109,98,101,114,92,34,58,52,48,50,57,48,54,56,44,92,34,112,97,103,101,85,82,76,92,34,58,92,34,104,116,116,112,115,58,47,47,119,119,119,46,107,108,111,111,107,46,99,111,109,47,122,104,45,72,75,47,97,99,116,105,118,105,116,121,47,55,49,92,34,44,92,34,114,101,118,105,101,119,78,117,109,98,101,114,92,34,58,50,57,51,56,50,52,44,92,34,114,101,118,105,101,119,82,97,116,105,110,103,92,34,58,52,46,57,125,44,92,34,114,101,99,111,109,109,101,110,100,101,100,65,99,116,105,118,105,116,121,51,92,34,58,123,92,34,73,109,97,103,101,85,82,76,92,34,58,92,34,104,116,116,112,115,58,47,47,114,101,115,46,107,108,111,111,107,46,99,111,109,47,105,109,97,103,101,47,117,112,108,111,97,100,47,97,99,116,105,118,105,116,105,101,115,47,119,103,119,55,102,56,110,48,110,108,122,106,48,54,51,113,122,121,107,52,46,106,112,103,92,34,44,92,34,78,97,109,101,92,34,58,92,34,227,128,144,231,141,168,229,174,182,229,132,170,230,131,160,227,128,145,233,166,153,230,184,175,232,191,170,229,163,171,229,176,188,230,168,130,229,156,146,233,150,128,231,165,168,32,43,32,229,146,150,229,149,161,229,132,170,230,131,160,92,34,44,92,34,80,114,105,99,101,92,34,58,92,34,72,75,36,53,55,51,46,48,92,34,44,92,34,98,111,111,107,105,110,103,78,117,109,98,101,114,92,34,58,50,55,53,53,52,57,56,44,92,34,112,97,103,101,85,82,76,92,34,58,92,34,104,116,116,112,115,58,47,47,119,119,119,46,107,108,111,111,107,46,99,111,109,47,122,104,45,72,75,47,97,99,116,105,118,105,116,121,47,51,57,92,34,44,92,34,114,101,118,105,101,119,78,117,109,98,101,114,92,34,58,49,50,56,52,54,57,44,92,34,114,101,118,105,101,119,82,97,116,105,110,103,92,34,58,52,46,56,125,44,92,34,114,101,118,105,101,119,78,117,109,98,101,114,92,34,58,49,57,50,44,92,34,114,101,118,105,101,119,82,97,116,105,110,103,92,34,58,52,46,55,44,92,34,118,101,114,116,105,99,97,108,84,121,112,101,92,34,58,92,34,65,99,116,105,118,105,116,105,101,115,32,92,92,117,48,48,50,54,32,69,120,112,101,114,105,101,110,99,101,115,92,34,125,44,92,34,117,115,101,114,73,100,92,34,58,92,34,48,100,56,57,101,53,102,99,57,99,52,56,54,97,51,97,99,52,100,53,54,101,56,55,51,52,98,56,51,57,53,99,102,101,92,34,125,34,125,18,30,10,8,75,77,81,45,84,101,115,116,18,8,75,77,81,45,84,101,115,116,40,136,189,254,221,252,139,146,162,22}
-	}
-	fmt.Println(len(msg))
-	published:=0
+
+	published := 0
 	start := time.Now()
 
-	if !sync {
+	var localHist *hdrhistogram.Histogram
+	var mu sync.Mutex
+	if hist {
+		localHist = hdrhistogram.New(HistMinValue, HistMaxValue, HistSigFigs)
+	}
+
+	trackWindow := warmup > 0 || cooldown > 0
+	var times []time.Time
+	if trackWindow {
+		times = make([]time.Time, 0, numMsgs)
+	}
+
+	if !syncPub {
 		ch := make(chan bool)
-		acb := func(lguid string, err error) {
-			if err != nil {
-				log.Fatalf("Publisher %q got following error: %v", pubID, err)
+		for i := 0; i < numMsgs; i++ {
+			rl.wait()
+			data := payloads[i%len(payloads)]
+			if hist {
+				data = withLatencyPrefix(data)
 			}
-			published++
-			if published >= numMsgs {
-				ch <- true
+			sentAt := time.Now()
+			if trackWindow {
+				times = append(times, sentAt)
 			}
-		}
-		for i := 0; i < numMsgs; i++ {
-			_, err := snc.PublishAsync(subj, msg, acb)
+			err := ps.PublishAsync(subj, data, func(err error) {
+				if err != nil {
+					log.Fatalf("Publisher %q got following error: %v", pubID, err)
+				}
+				mu.Lock()
+				if hist {
+					localHist.RecordValue(int64(time.Since(sentAt)))
+				}
+				published++
+				done := published >= numMsgs
+				mu.Unlock()
+				if done {
+					close(ch)
+				}
+			})
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -195,29 +800,45 @@ func runPublisher(startwg, donewg *sync.WaitGroup, url string, opts []nats.Optio
 		<-ch
 	} else {
 		for i := 0; i < numMsgs; i++ {
-			err := snc.Publish(subj, msg)
-			if err != nil {
+			rl.wait()
+			data := payloads[i%len(payloads)]
+			if hist {
+				data = withLatencyPrefix(data)
+			}
+			if err := ps.Publish(subj, data); err != nil {
 				log.Fatal(err)
 			}
 			published++
+			if trackWindow {
+				times = append(times, time.Now())
+			}
 		}
 	}
 
-	benchmark.AddPubSample(bench.NewSample(numMsgs, msgSize, start, time.Now(), snc.NatsConn()))
-	snc.Close()
-	nc.Close()
+	if hist {
+		histMu.Lock()
+		pubAckHist.Merge(localHist)
+		histMu.Unlock()
+	}
+
+	if trackWindow {
+		if n, s, e, ok := sampleWindow(times, warmup, cooldown); ok {
+			benchmark.AddPubSample(bench.NewSample(n, msgSize, s, e, ps.NatsConn()))
+		} else {
+			log.Printf("Publisher %s: warmup/cooldown trimmed all %d messages, skipping sample\n", pubID, numMsgs)
+		}
+	} else {
+		benchmark.AddPubSample(bench.NewSample(numMsgs, msgSize, start, time.Now(), ps.NatsConn()))
+	}
+	ps.Close()
 	donewg.Done()
 }
 
-func runSubscriber(startwg, donewg *sync.WaitGroup, url string, opts []nats.Option, clusterID, subID, queue string, numMsgs, msgSize int, ignoreOld bool) {
-	nc, err := nats.Connect(url, opts...)
-	if err != nil {
-		log.Fatalf("Subscriber %s can't connect: %v\n", subID, err)
-	}
-	snc, err := stan.Connect(clusterID, subID, stan.NatsConn(nc),
-		stan.SetConnectionLostHandler(func(_ stan.Conn, reason error) {
-			log.Fatalf("Connection lost, reason: %v", reason)
-		}))
+// runSubscriber drives one subscriber goroutine against whatever Transport
+// it is given, so the same benchmark loop runs unmodified against core
+// NATS, NATS Streaming or JetStream.
+func runSubscriber(t Transport, startwg, donewg *sync.WaitGroup, url string, opts []nats.Option, subID, queue string, numMsgs, msgSize int, subOpts SubOpts, hist bool, warmup, cooldown time.Duration) {
+	ps, err := t.Connect(url, opts, subID)
 	if err != nil {
 		log.Fatalf("Subscriber %s can't connect: %v\n", subID, err)
 	}
@@ -226,30 +847,43 @@ func runSubscriber(startwg, donewg *sync.WaitGroup, url string, opts []nats.Opti
 	subj := args[0]
 	ch := make(chan time.Time, 2)
 
+	var localHist *hdrhistogram.Histogram
+	if hist {
+		localHist = hdrhistogram.New(HistMinValue, HistMaxValue, HistSigFigs)
+	}
+
+	trackWindow := warmup > 0 || cooldown > 0
+	var times []time.Time
+	if trackWindow {
+		times = make([]time.Time, 0, numMsgs)
+	}
+
 	isQueue := queue != ""
 	received := 0
-	mcb := func(msg *stan.Msg) {
+	cb := func(data []byte) {
 		received++
+		now := time.Now()
 		if received == 1 {
-			ch <- time.Now()
+			ch <- now
+		}
+		if trackWindow {
+			times = append(times, now)
+		}
+		if hist {
+			recordLatency(localHist, data)
 		}
 		if isQueue {
 			if atomic.AddInt32(&qTotalRecv, 1) >= int32(numMsgs) {
-				ch <- time.Now()
+				ch <- now
 			}
 		} else {
 			if received >= numMsgs {
-				ch <- time.Now()
+				ch <- now
 			}
 		}
 	}
 
-	var sub stan.Subscription
-	if ignoreOld {
-		sub, err = snc.QueueSubscribe(subj, queue, mcb)
-	} else {
-		sub, err = snc.QueueSubscribe(subj, queue, mcb, stan.DeliverAllAvailable())
-	}
+	sub, err := ps.Subscribe(subj, queue, subOpts, cb)
 	if err != nil {
 		log.Fatalf("Subscriber %s can't subscribe: %v", subID, err)
 	}
@@ -257,18 +891,30 @@ func runSubscriber(startwg, donewg *sync.WaitGroup, url string, opts []nats.Opti
 
 	start := <-ch
 	end := <-ch
-	benchmark.AddSubSample(bench.NewSample(received, msgSize, start, end, snc.NatsConn()))
+	if trackWindow {
+		if n, s, e, ok := sampleWindow(times, warmup, cooldown); ok {
+			benchmark.AddSubSample(bench.NewSample(n, msgSize, s, e, ps.NatsConn()))
+		} else {
+			log.Printf("Subscriber %s: warmup/cooldown trimmed all %d messages, skipping sample\n", subID, received)
+		}
+	} else {
+		benchmark.AddSubSample(bench.NewSample(received, msgSize, start, end, ps.NatsConn()))
+	}
 	// For queues, since not each member receives the total number of messages,
 	// when a member is done, it needs to publish a message to unblock other member(s).
 	if isQueue {
 		if sr := atomic.AddInt32(&qSubsLeft, -1); sr > 0 {
-			// Close this queue member first so that there is no chance that the
+			// Close this subscription first so that there is no chance that the
 			// server sends the message we are going to publish back to this member.
-			sub.Close()
-			snc.Publish(subj, []byte("done"))
+			sub.Unsubscribe()
+			ps.Publish(subj, []byte("done"))
 		}
 	}
-	snc.Close()
-	nc.Close()
+	if hist {
+		histMu.Lock()
+		subLatencyHist.Merge(localHist)
+		histMu.Unlock()
+	}
+	ps.Close()
 	donewg.Done()
 }